@@ -0,0 +1,531 @@
+// INTERLOCK | https://github.com/inversepath/interlock
+// Copyright (c) 2015 Inverse Path S.r.l.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build textsecure
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/emersion/go-vcard"
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/carddav"
+)
+
+// storedContact is INTERLOCK's structured replacement for the bare
+// "Name +number.textsecure" filename convention: a single record can
+// carry multiple numbers, free-form notes, an avatar and the contact's
+// Signal safety number, imported from a vCard or a CardDAV address book.
+type storedContact struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	Numbers      []string `json:"numbers"`
+	Notes        string   `json:"notes,omitempty"`
+	Avatar       []byte   `json:"avatar,omitempty"`
+	SafetyNumber string   `json:"safetyNumber,omitempty"`
+}
+
+func contactsStorePath() string {
+	return filepath.Join(contactsPath(), "store")
+}
+
+func contactStorePath(id string) string {
+	return filepath.Join(contactsStorePath(), id+".json")
+}
+
+// carddavCredentialsPath holds the (optional) basic-auth password or
+// bearer token used to pull a CardDAV address book. It lives next to the
+// TextSecure private key material, on the LUKS volume.
+func carddavCredentialsPath() string {
+	return filepath.Join(storagePath(), "carddav")
+}
+
+func loadStoredContacts() (contacts []storedContact, err error) {
+	err = os.MkdirAll(contactsStorePath(), 0700)
+
+	if err != nil {
+		return
+	}
+
+	files, err := filepath.Glob(filepath.Join(contactsStorePath(), "*.json"))
+
+	if err != nil {
+		return
+	}
+
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+
+		if err != nil {
+			return nil, err
+		}
+
+		var c storedContact
+
+		if err := json.Unmarshal(data, &c); err != nil {
+			return nil, err
+		}
+
+		contacts = append(contacts, c)
+	}
+
+	return
+}
+
+func loadStoredContact(id string) (c storedContact, err error) {
+	data, err := ioutil.ReadFile(contactStorePath(id))
+
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, &c)
+
+	return
+}
+
+func saveStoredContact(c storedContact) error {
+	if c.ID == "" {
+		return errors.New("contact id cannot be empty")
+	}
+
+	err := os.MkdirAll(contactsStorePath(), 0700)
+
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(c)
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(contactStorePath(c.ID), data, 0600)
+}
+
+func deleteStoredContact(id string) error {
+	err := os.Remove(contactStorePath(id))
+
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// findStoredContactByNumber looks up a structured contact by any of its
+// E.164 numbers, used by getContact to resolve incoming messages.
+func findStoredContactByNumber(number string) (storedContact, bool) {
+	contacts, err := loadStoredContacts()
+
+	if err != nil {
+		return storedContact{}, false
+	}
+
+	for _, c := range contacts {
+		for _, n := range c.Numbers {
+			if n == number {
+				return c, true
+			}
+		}
+	}
+
+	return storedContact{}, false
+}
+
+// contactIDForNumber derives a stable, filesystem-safe id from a
+// contact's first number.
+func contactIDForNumber(number string) string {
+	return strings.TrimLeft(number, "+")
+}
+
+func (t *textSecure) contacts(w http.ResponseWriter, r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"action:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	switch req["action"].(string) {
+	case "list":
+		return listStoredContacts()
+	case "get":
+		return getStoredContact(req)
+	case "create", "update":
+		return upsertStoredContact(req)
+	case "delete":
+		return removeStoredContact(req)
+	case "import":
+		return importContacts(req)
+	default:
+		return errorResponse(fmt.Errorf("unknown contacts action: %v", req["action"]), "")
+	}
+}
+
+func listStoredContacts() (res jsonObject) {
+	contacts, err := loadStoredContacts()
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	return jsonObject{
+		"status":   "OK",
+		"response": contacts,
+	}
+}
+
+func getStoredContact(req map[string]interface{}) (res jsonObject) {
+	err := validateRequest(req, []string{"id:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	c, err := loadStoredContact(req["id"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	return jsonObject{
+		"status":   "OK",
+		"response": c,
+	}
+}
+
+func upsertStoredContact(req map[string]interface{}) (res jsonObject) {
+	err := validateRequest(req, []string{"name:s", "numbers:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	numbers := strings.Split(req["numbers"].(string), ",")
+
+	for i := range numbers {
+		numbers[i] = strings.TrimSpace(numbers[i])
+	}
+
+	if len(numbers) == 0 || numbers[0] == "" {
+		return errorResponse(errors.New("at least one number is required"), "")
+	}
+
+	id := contactIDForNumber(numbers[0])
+
+	if v, ok := req["id"]; ok {
+		id = v.(string)
+	}
+
+	c := storedContact{
+		ID:      id,
+		Name:    req["name"].(string),
+		Numbers: numbers,
+	}
+
+	if v, ok := req["notes"]; ok {
+		c.Notes = v.(string)
+	}
+
+	if v, ok := req["safetyNumber"]; ok {
+		c.SafetyNumber = v.(string)
+	}
+
+	if v, ok := req["avatar"]; ok {
+		avatarPath, err := absolutePath(v.(string))
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		c.Avatar, err = ioutil.ReadFile(avatarPath)
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+	}
+
+	if err := saveStoredContact(c); err != nil {
+		return errorResponse(err, "")
+	}
+
+	return jsonObject{
+		"status":   "OK",
+		"response": c,
+	}
+}
+
+func removeStoredContact(req map[string]interface{}) (res jsonObject) {
+	err := validateRequest(req, []string{"id:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if err := deleteStoredContact(req["id"].(string)); err != nil {
+		return errorResponse(err, "")
+	}
+
+	return jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+}
+
+// importContacts reconciles either an uploaded .vcf file (req["vcf"], a
+// path as used elsewhere for file parameters) or a CardDAV address book
+// (req["carddavUrl"], with optional req["carddavUser"]/req["carddavToken"]
+// basic-auth or bearer credentials, persisted to carddavCredentialsPath())
+// into the structured contact store, matching existing entries by number.
+func importContacts(req map[string]interface{}) (res jsonObject) {
+	var imported []storedContact
+	var err error
+
+	if v, ok := req["vcf"]; ok {
+		vcfPath, err := absolutePath(v.(string))
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		data, err := ioutil.ReadFile(vcfPath)
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		imported, err = parseVCards(data)
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+	} else if v, ok := req["carddavUrl"]; ok {
+		creds := carddavCredentials{}
+
+		if u, ok := req["carddavUser"]; ok {
+			creds.User, _ = u.(string)
+		}
+
+		if p, ok := req["carddavPassword"]; ok {
+			creds.Password, _ = p.(string)
+		}
+
+		if tok, ok := req["carddavToken"]; ok {
+			creds.Token, _ = tok.(string)
+		}
+
+		if err := saveCardDAVCredentials(creds); err != nil {
+			return errorResponse(err, "")
+		}
+
+		imported, err = fetchCardDAVContacts(v.(string), creds)
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+	} else {
+		return errorResponse(errors.New("import requires either vcf or carddavUrl"), "")
+	}
+
+	merged, err := reconcileContacts(imported)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	return jsonObject{
+		"status":   "OK",
+		"response": merged,
+	}
+}
+
+// reconcileContacts merges imported against the existing store, matching
+// by any shared number: a match updates the existing record in place
+// (keeping its id), otherwise a new record is created. existing is loaded
+// once up front and grown in memory as contacts are merged, rather than
+// re-reading the whole store from disk for every imported contact.
+func reconcileContacts(imported []storedContact) (merged []storedContact, err error) {
+	existing, err := loadStoredContacts()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range imported {
+		c.ID = matchContactID(c, existing)
+
+		if c.ID == "" {
+			continue
+		}
+
+		if err = saveStoredContact(c); err != nil {
+			return nil, err
+		}
+
+		merged = append(merged, c)
+		existing = append(existing, c)
+	}
+
+	return merged, nil
+}
+
+// matchContactID returns the id an imported contact should be saved
+// under: the id of an existing record sharing any of its numbers, or
+// failing that, imported's own id if it set one, or else a fresh id
+// derived from its first number. It returns "" if none of these apply
+// (no number match, no id, and no number to derive one from).
+func matchContactID(imported storedContact, existing []storedContact) string {
+	for _, n := range imported.Numbers {
+		for _, c := range existing {
+			for _, en := range c.Numbers {
+				if n == en {
+					return c.ID
+				}
+			}
+		}
+	}
+
+	if imported.ID != "" {
+		return imported.ID
+	}
+
+	if len(imported.Numbers) > 0 {
+		return contactIDForNumber(imported.Numbers[0])
+	}
+
+	return ""
+}
+
+// parseVCards decodes one or more vCard 4.0 records into storedContacts.
+func parseVCards(data []byte) (contacts []storedContact, err error) {
+	dec := vcard.NewDecoder(bytes.NewReader(data))
+
+	for {
+		card, err := dec.Decode()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if c, ok := contactFromVCard(card); ok {
+			contacts = append(contacts, c)
+		}
+	}
+
+	return
+}
+
+// contactFromVCard extracts the fields INTERLOCK cares about from a
+// decoded vCard, discarding entries with no usable E.164 number.
+func contactFromVCard(card vcard.Card) (c storedContact, ok bool) {
+	c.Name = card.PreferredValue(vcard.FieldFormattedName)
+	c.SafetyNumber = card.PreferredValue("X-SIGNAL-SAFETY-NUMBER")
+
+	if notes := card.Values(vcard.FieldNote); len(notes) > 0 {
+		c.Notes = notes[0]
+	}
+
+	for _, tel := range card[vcard.FieldTelephone] {
+		if numberPattern.MatchString(tel.Value) {
+			c.Numbers = append(c.Numbers, tel.Value)
+		}
+	}
+
+	if len(c.Numbers) == 0 {
+		return storedContact{}, false
+	}
+
+	c.ID = contactIDForNumber(c.Numbers[0])
+
+	return c, true
+}
+
+type carddavCredentials struct {
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+}
+
+func saveCardDAVCredentials(c carddavCredentials) error {
+	data, err := json.Marshal(c)
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(carddavCredentialsPath(), data, 0600)
+}
+
+// fetchCardDAVContacts queries addr's default address book over CardDAV
+// (basic-auth if creds.User/Password are set, bearer token if
+// creds.Token is set) and returns every entry as a storedContact.
+func fetchCardDAVContacts(addr string, creds carddavCredentials) (contacts []storedContact, err error) {
+	var httpClient webdav.HTTPClient
+
+	switch {
+	case creds.Token != "":
+		httpClient = webdav.HTTPClientWithBearerAuth(http.DefaultClient, creds.Token)
+	case creds.User != "":
+		httpClient = webdav.HTTPClientWithBasicAuth(http.DefaultClient, creds.User, creds.Password)
+	default:
+		httpClient = http.DefaultClient
+	}
+
+	client, err := carddav.NewClient(httpClient, addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	homeSet, err := client.FindAddressBookHomeSet(addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	addressBooks, err := client.FindAddressBooks(homeSet)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ab := range addressBooks {
+		objects, err := client.QueryAddressBook(ab.Path, &carddav.AddressBookQuery{})
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range objects {
+			if c, ok := contactFromVCard(obj.Card); ok {
+				contacts = append(contacts, c)
+			}
+		}
+	}
+
+	return contacts, nil
+}
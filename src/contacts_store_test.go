@@ -0,0 +1,102 @@
+// INTERLOCK | https://github.com/inversepath/interlock
+// Copyright (c) 2015 Inverse Path S.r.l.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build textsecure
+
+package main
+
+import "testing"
+
+func TestMatchContactIDMatchesExistingNumber(t *testing.T) {
+	existing := []storedContact{
+		{ID: "15551234567", Name: "Alice", Numbers: []string{"+15551234567"}},
+	}
+
+	imported := storedContact{Name: "Alice Cooper", Numbers: []string{"+15551234567", "+15557654321"}}
+
+	if id := matchContactID(imported, existing); id != "15551234567" {
+		t.Fatalf("matchContactID = %q, want %q", id, "15551234567")
+	}
+}
+
+func TestMatchContactIDKeepsImportedID(t *testing.T) {
+	imported := storedContact{ID: "custom-id", Name: "Bob", Numbers: []string{"+15559876543"}}
+
+	if id := matchContactID(imported, nil); id != "custom-id" {
+		t.Fatalf("matchContactID = %q, want %q", id, "custom-id")
+	}
+}
+
+func TestMatchContactIDDerivesFromFirstNumber(t *testing.T) {
+	imported := storedContact{Name: "Carol", Numbers: []string{"+15550001111", "+15552223333"}}
+
+	if id := matchContactID(imported, nil); id != "15550001111" {
+		t.Fatalf("matchContactID = %q, want %q", id, "15550001111")
+	}
+}
+
+func TestMatchContactIDEmptyWithoutNumberOrID(t *testing.T) {
+	imported := storedContact{Name: "No Number"}
+
+	if id := matchContactID(imported, nil); id != "" {
+		t.Fatalf("matchContactID = %q, want empty", id)
+	}
+}
+
+func TestParseVCards(t *testing.T) {
+	data := []byte("BEGIN:VCARD\r\n" +
+		"VERSION:4.0\r\n" +
+		"FN:Jane Doe\r\n" +
+		"TEL:+15551230000\r\n" +
+		"NOTE:met at conference\r\n" +
+		"END:VCARD\r\n")
+
+	contacts, err := parseVCards(data)
+
+	if err != nil {
+		t.Fatalf("parseVCards: %v", err)
+	}
+
+	if len(contacts) != 1 {
+		t.Fatalf("expected 1 contact, got %d", len(contacts))
+	}
+
+	c := contacts[0]
+
+	if c.Name != "Jane Doe" {
+		t.Fatalf("Name = %q, want %q", c.Name, "Jane Doe")
+	}
+
+	if len(c.Numbers) != 1 || c.Numbers[0] != "+15551230000" {
+		t.Fatalf("Numbers = %v, want [+15551230000]", c.Numbers)
+	}
+
+	if c.Notes != "met at conference" {
+		t.Fatalf("Notes = %q, want %q", c.Notes, "met at conference")
+	}
+
+	if c.ID != "15551230000" {
+		t.Fatalf("ID = %q, want %q", c.ID, "15551230000")
+	}
+}
+
+func TestParseVCardsDiscardsEntriesWithoutAUsableNumber(t *testing.T) {
+	data := []byte("BEGIN:VCARD\r\n" +
+		"VERSION:4.0\r\n" +
+		"FN:No Number Here\r\n" +
+		"TEL:not-a-number\r\n" +
+		"END:VCARD\r\n")
+
+	contacts, err := parseVCards(data)
+
+	if err != nil {
+		t.Fatalf("parseVCards: %v", err)
+	}
+
+	if len(contacts) != 0 {
+		t.Fatalf("expected 0 contacts, got %d", len(contacts))
+	}
+}
@@ -0,0 +1,150 @@
+// INTERLOCK | https://github.com/inversepath/interlock
+// Copyright (c) 2015 Inverse Path S.r.l.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build textsecure
+
+package main
+
+import (
+	"context"
+	"log/syslog"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const listenerBackoffBase = 1 * time.Second
+const listenerBackoffCeiling = 60 * time.Second
+const listenerBackoffResetAfter = 5 * time.Minute
+const listenerJitter = 0.25
+
+// listenerStopGracePeriod bounds how long Stop() waits for run()'s
+// goroutine to exit after calling stop. Neither signalTransportV2 nor
+// signalTransportV3 can currently interrupt a blocked Listen() call (see
+// their Stop() implementations), so that goroutine may never exit on its
+// own; Stop() falls through after this grace period rather than hanging
+// logout forever, leaving the old listen call to unwind in the
+// background (or die with the process).
+const listenerStopGracePeriod = 2 * time.Second
+
+// listenerSupervisor owns the lifecycle of a long-lived message listener:
+// it restarts listen on transient errors with a truncated exponential
+// backoff, can be asked to Stop() cleanly (e.g. on logout or LUKS close),
+// and tracks messageHandler goroutines so Stop() can drain them before
+// returning.
+type listenerSupervisor struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	listen   func(ctx context.Context) error
+	stop     func() error
+	done     chan struct{}
+	inFlight sync.WaitGroup
+}
+
+// newListenerSupervisor creates a supervisor around listen, which should
+// block until the underlying transport's listen loop ends (normally with
+// a transient error). stop is called by Stop() to interrupt a blocked
+// listen call; cancelling ctx alone cannot do that since listen blocks
+// inside the transport, not on ctx.
+func newListenerSupervisor(listen func(ctx context.Context) error, stop func() error) *listenerSupervisor {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &listenerSupervisor{
+		ctx:    ctx,
+		cancel: cancel,
+		listen: listen,
+		stop:   stop,
+		done:   make(chan struct{}),
+	}
+}
+
+// Start runs the retry loop in a new goroutine.
+func (s *listenerSupervisor) Start() {
+	go s.run()
+}
+
+func (s *listenerSupervisor) run() {
+	defer close(s.done)
+
+	backoff := listenerBackoffBase
+
+	for {
+		if s.ctx.Err() != nil {
+			return
+		}
+
+		started := time.Now()
+		err := s.listen(s.ctx)
+
+		if s.ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			status.Log(syslog.LOG_ERR, "TextSecure message listener error: %v", err)
+		}
+
+		if time.Since(started) > listenerBackoffResetAfter {
+			backoff = listenerBackoffBase
+		}
+
+		wait := withJitter(backoff)
+		n := status.Notify(syslog.LOG_NOTICE, "TextSecure transport disconnected, reconnecting in %s", wait)
+
+		select {
+		case <-time.After(wait):
+		case <-s.ctx.Done():
+			status.Remove(n)
+			return
+		}
+
+		status.Remove(n)
+		status.Log(syslog.LOG_NOTICE, "TextSecure message listener reconnecting")
+
+		backoff *= 2
+
+		if backoff > listenerBackoffCeiling {
+			backoff = listenerBackoffCeiling
+		}
+	}
+}
+
+// withJitter returns d randomized by ±listenerJitter.
+func withJitter(d time.Duration) time.Duration {
+	delta := float64(d) * listenerJitter
+	return d - time.Duration(delta) + time.Duration(rand.Float64()*2*delta)
+}
+
+// Track registers a messageHandler invocation as in-flight; the caller
+// must invoke the returned func once it completes. Stop() waits for
+// every tracked invocation before returning.
+func (s *listenerSupervisor) Track() func() {
+	s.inFlight.Add(1)
+	return s.inFlight.Done
+}
+
+// Stop cancels the retry loop, asks stop to interrupt a blocked listen
+// call (cancelling ctx alone cannot reach into the transport's own
+// blocking read), and waits up to listenerStopGracePeriod for the loop
+// to exit before giving up on it. It then waits for every tracked
+// messageHandler invocation to complete, and returns. Stop is safe to
+// call even when run()'s goroutine never exits (see
+// listenerStopGracePeriod): logout is no longer blocked on a transport
+// that cannot be interrupted.
+func (s *listenerSupervisor) Stop() {
+	s.cancel()
+
+	if s.stop != nil {
+		_ = s.stop()
+	}
+
+	select {
+	case <-s.done:
+	case <-time.After(listenerStopGracePeriod):
+	}
+
+	s.inFlight.Wait()
+}
@@ -0,0 +1,621 @@
+// INTERLOCK | https://github.com/inversepath/interlock
+// Copyright (c) 2015 Inverse Path S.r.l.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package messaging
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// HistoryRecord is one entry in a contact's conversation history.
+type HistoryRecord struct {
+	Timestamp time.Time
+	Direction string // ">" outbound, "<" inbound
+	Mime      string
+	Body      string
+	BodyHash  [sha256.Size]byte
+}
+
+// HistoryStore is implemented by backends whose history supports
+// pagination, full-text search and tamper evidence, beyond a flat
+// HistoryPath() file.
+type HistoryStore interface {
+	AppendHistory(contact string, direction string, mime string, body string, t time.Time) error
+	QueryHistory(contact string, before time.Time, after time.Time, limit int, q string) ([]HistoryRecord, error)
+	VerifyHistory(contact string) (ok bool, brokenAt int, err error)
+}
+
+var metaBucket = []byte("meta")
+var timeBucket = []byte("timestamps")
+var wordBucket = []byte("words")
+var lastMACKey = []byte("lastMAC")
+var lastOffsetKey = []byte("lastOffset")
+
+// FileHistoryStore implements HistoryStore as, per contact, a
+// length-prefixed append-only log of HMAC-SHA256-chained records, with a
+// BoltDB index over (timestamp, keyword) used for pagination and
+// full-text search. VerifyHistory does not use the index: it walks the
+// log itself.
+type FileHistoryStore struct {
+	logDir   string
+	indexDir string
+	macKey   []byte
+
+	mu  sync.Mutex
+	dbs map[string]*bolt.DB
+}
+
+// NewFileHistoryStore returns a store rooted at logDir/indexDir, both of
+// which are expected to live on the encrypted volume, along with macKey,
+// the key chaining the log's per-record HMACs.
+func NewFileHistoryStore(logDir string, indexDir string, macKey []byte) *FileHistoryStore {
+	return &FileHistoryStore{logDir: logDir, indexDir: indexDir, macKey: macKey, dbs: make(map[string]*bolt.DB)}
+}
+
+func (s *FileHistoryStore) logPath(contact string) string {
+	return filepath.Join(s.logDir, contact+".log")
+}
+
+func (s *FileHistoryStore) indexPath(contact string) string {
+	return filepath.Join(s.indexDir, contact+".idx")
+}
+
+// openIndex returns contact's index DB, opening, bucket-initializing and
+// reconciling it at most once per contact for the lifetime of the store.
+// AppendHistory/QueryHistory used to bolt.Open+reconcile+Close around
+// every single call, re-flocking and re-stating the index file and
+// serializing unrelated appends/queries on that file lock; the open
+// handle is now cached and reused instead, and released by Close.
+func (s *FileHistoryStore) openIndex(contact string) (*bolt.DB, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if db, ok := s.dbs[contact]; ok {
+		return db, nil
+	}
+
+	if err := os.MkdirAll(s.indexDir, 0700); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(s.indexPath(contact), 0600, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{metaBucket, timeBucket, wordBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := s.reconcile(db, contact); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s.dbs[contact] = db
+
+	return db, nil
+}
+
+// Close closes every index DB opened by this store. A cipher that keeps
+// a FileHistoryStore for the lifetime of a session should call this on
+// teardown (e.g. from Deactivate) so file locks are released promptly
+// instead of only at process exit.
+func (s *FileHistoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var firstErr error
+
+	for contact, db := range s.dbs {
+		if err := db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+
+		delete(s.dbs, contact)
+	}
+
+	return firstErr
+}
+
+// reconcile catches the index up with any log records written after the
+// index's last recorded offset. AppendHistory fsyncs a record to the log
+// before committing the matching index update, so a crash between those
+// two steps leaves the log ahead of the index rather than the reverse;
+// reconcile replays the records in that gap so a dead process never
+// leaves the MAC chain looking broken just because the index lags.
+//
+// A short read while still inside the length/body/MAC of a record is
+// treated as that same kind of dangling write and simply stops the
+// replay there, leaving the index's offset before it so the next
+// AppendHistory overwrites it. But once a record's bytes are fully
+// present on disk, a stored MAC that does not match the chain or a gob
+// decode failure is corruption, not a dangling write, and reconcile must
+// not commit an offset/MAC past it: doing so would make the next append
+// seek past the broken record and silently overwrite (and lose) it and
+// everything after it. It returns a hard error instead, so callers see
+// the contact's history as unavailable rather than quietly truncated.
+func (s *FileHistoryStore) reconcile(db *bolt.DB, contact string) error {
+	info, err := os.Stat(s.logPath(contact))
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+
+		var offset int64
+
+		if b := meta.Get(lastOffsetKey); b != nil {
+			offset = int64(binary.BigEndian.Uint64(b))
+		}
+
+		if offset >= info.Size() {
+			return nil
+		}
+
+		log, err := os.Open(s.logPath(contact))
+
+		if err != nil {
+			return err
+		}
+		defer log.Close()
+
+		if _, err := log.Seek(offset, os.SEEK_SET); err != nil {
+			return err
+		}
+
+		prevMAC := meta.Get(lastMACKey)
+
+		if prevMAC == nil {
+			prevMAC = s.macKey
+		}
+
+		timestamps := tx.Bucket(timeBucket)
+		words := tx.Bucket(wordBucket)
+
+		for offset < info.Size() {
+			recordOffset := offset
+
+			var header [4]byte
+
+			if _, err := io.ReadFull(log, header[:]); err != nil {
+				// Partial record from a write that never reached the
+				// fsync that would have made AppendHistory proceed to
+				// commit an index update for it; nothing more to
+				// reconcile until the next append overwrites it.
+				break
+			}
+
+			length := binary.BigEndian.Uint32(header[:])
+			encoded := make([]byte, length)
+
+			if _, err := io.ReadFull(log, encoded); err != nil {
+				break
+			}
+
+			storedMAC := make([]byte, sha256.Size)
+
+			if _, err := io.ReadFull(log, storedMAC); err != nil {
+				break
+			}
+
+			// The full record is present on disk past this point, so any
+			// failure below is the chain being broken, not a dangling
+			// write.
+			mac := s.mac(prevMAC, encoded)
+
+			if !hmac.Equal(mac, storedMAC) {
+				return fmt.Errorf("history for %s is broken at offset %d: stored MAC does not match the chain, refusing to advance the index past it", contact, recordOffset)
+			}
+
+			var record HistoryRecord
+
+			if err := gob.NewDecoder(bytes.NewReader(encoded)).Decode(&record); err != nil {
+				return fmt.Errorf("history for %s is broken at offset %d: %v, refusing to advance the index past it", contact, recordOffset, err)
+			}
+
+			var offsetBytes [8]byte
+			binary.BigEndian.PutUint64(offsetBytes[:], uint64(recordOffset))
+
+			if err := timestamps.Put(timeKey(record.Timestamp, recordOffset), offsetBytes[:]); err != nil {
+				return err
+			}
+
+			for _, word := range tokenize(record.Body) {
+				key := append([]byte(word), 0)
+				key = append(key, timeKey(record.Timestamp, recordOffset)...)
+
+				if err := words.Put(key, offsetBytes[:]); err != nil {
+					return err
+				}
+			}
+
+			prevMAC = mac
+			offset = recordOffset + int64(len(header)+len(encoded)+len(mac))
+		}
+
+		if err := meta.Put(lastMACKey, prevMAC); err != nil {
+			return err
+		}
+
+		var offsetBytes [8]byte
+		binary.BigEndian.PutUint64(offsetBytes[:], uint64(offset))
+
+		return meta.Put(lastOffsetKey, offsetBytes[:])
+	})
+}
+
+// mac computes the chained HMAC-SHA256 over prevMAC and the gob-encoded
+// record, binding every entry to the full history of records before it.
+func (s *FileHistoryStore) mac(prevMAC []byte, encoded []byte) []byte {
+	h := hmac.New(sha256.New, s.macKey)
+	h.Write(prevMAC)
+	h.Write(encoded)
+	return h.Sum(nil)
+}
+
+// AppendHistory appends a record to contact's log, chaining it off the
+// last appended record's MAC (tracked in the index to avoid re-reading
+// the whole log on every call), and indexes it by timestamp and keyword.
+//
+// The log append is fsynced before the index transaction that records it
+// is committed, never the other way round, so a crash in between leaves
+// the log ahead of the index rather than silently advancing the MAC
+// chain's notion of "last record" past something that was never durably
+// written. openIndex's reconcile step replays that gap on next use.
+func (s *FileHistoryStore) AppendHistory(contact string, direction string, mime string, body string, t time.Time) error {
+	if err := os.MkdirAll(s.logDir, 0700); err != nil {
+		return err
+	}
+
+	db, err := s.openIndex(contact)
+
+	if err != nil {
+		return err
+	}
+
+	record := HistoryRecord{
+		Timestamp: t,
+		Direction: direction,
+		Mime:      mime,
+		Body:      body,
+		BodyHash:  sha256.Sum256([]byte(body)),
+	}
+
+	var buf bytes.Buffer
+
+	if err := gob.NewEncoder(&buf).Encode(record); err != nil {
+		return err
+	}
+
+	encoded := buf.Bytes()
+
+	var prevMAC []byte
+	var offset int64
+
+	err = db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		prevMAC = append([]byte(nil), meta.Get(lastMACKey)...)
+
+		if b := meta.Get(lastOffsetKey); b != nil {
+			offset = int64(binary.BigEndian.Uint64(b))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if prevMAC == nil {
+		prevMAC = s.macKey
+	}
+
+	mac := s.mac(prevMAC, encoded)
+
+	log, err := os.OpenFile(s.logPath(contact), os.O_WRONLY|os.O_CREATE, 0600)
+
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+
+	if _, err := log.Seek(offset, os.SEEK_SET); err != nil {
+		return err
+	}
+
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(encoded)))
+
+	if _, err := log.Write(header[:]); err != nil {
+		return err
+	}
+
+	if _, err := log.Write(encoded); err != nil {
+		return err
+	}
+
+	if _, err := log.Write(mac); err != nil {
+		return err
+	}
+
+	if err := log.Sync(); err != nil {
+		return err
+	}
+
+	newOffset := offset + int64(len(header)+len(encoded)+len(mac))
+
+	return db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+
+		if err := meta.Put(lastMACKey, mac); err != nil {
+			return err
+		}
+
+		var newOffsetBytes [8]byte
+		binary.BigEndian.PutUint64(newOffsetBytes[:], uint64(newOffset))
+
+		if err := meta.Put(lastOffsetKey, newOffsetBytes[:]); err != nil {
+			return err
+		}
+
+		var offsetBytes [8]byte
+		binary.BigEndian.PutUint64(offsetBytes[:], uint64(offset))
+
+		timestamps := tx.Bucket(timeBucket)
+
+		if err := timestamps.Put(timeKey(t, offset), offsetBytes[:]); err != nil {
+			return err
+		}
+
+		words := tx.Bucket(wordBucket)
+
+		for _, word := range tokenize(body) {
+			key := append([]byte(word), 0)
+			key = append(key, timeKey(t, offset)...)
+
+			if err := words.Put(key, offsetBytes[:]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// QueryHistory returns records for contact within (after, before),
+// newest first, optionally restricted to those whose body contains every
+// whitespace-separated token in q, capped at limit entries (0 = no cap).
+func (s *FileHistoryStore) QueryHistory(contact string, before time.Time, after time.Time, limit int, q string) (records []HistoryRecord, err error) {
+	db, err := s.openIndex(contact)
+
+	if err != nil {
+		return nil, err
+	}
+
+	log, err := os.Open(s.logPath(contact))
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+	defer log.Close()
+
+	var offsets [][]byte
+
+	err = db.View(func(tx *bolt.Tx) error {
+		offsets, err = matchingOffsets(tx, after, before, tokenize(q))
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(offsets) - 1; i >= 0; i-- {
+		if limit > 0 && len(records) >= limit {
+			break
+		}
+
+		record, err := readRecordAt(log, offsets[i])
+
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// VerifyHistory walks contact's log from the start, recomputing the MAC
+// chain, and reports whether it is intact. brokenAt is the zero-based
+// index of the first record that is cut short or whose stored MAC does
+// not match, or -1 if the chain is intact (including the case of an
+// empty or missing log).
+func (s *FileHistoryStore) VerifyHistory(contact string) (ok bool, brokenAt int, err error) {
+	log, err := os.Open(s.logPath(contact))
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, -1, nil
+		}
+
+		return false, -1, err
+	}
+	defer log.Close()
+
+	prevMAC := s.macKey
+
+	for i := 0; ; i++ {
+		var header [4]byte
+
+		if _, err := io.ReadFull(log, header[:]); err != nil {
+			if err == io.EOF {
+				return true, -1, nil
+			}
+
+			return false, -1, err
+		}
+
+		length := binary.BigEndian.Uint32(header[:])
+		encoded := make([]byte, length)
+
+		if _, err := io.ReadFull(log, encoded); err != nil {
+			return false, i, nil
+		}
+
+		storedMAC := make([]byte, sha256.Size)
+
+		if _, err := io.ReadFull(log, storedMAC); err != nil {
+			return false, i, nil
+		}
+
+		mac := s.mac(prevMAC, encoded)
+
+		if !hmac.Equal(mac, storedMAC) {
+			return false, i, nil
+		}
+
+		prevMAC = mac
+	}
+}
+
+func readRecordAt(log *os.File, offset []byte) (record HistoryRecord, err error) {
+	pos := int64(binary.BigEndian.Uint64(offset))
+
+	if _, err = log.Seek(pos, os.SEEK_SET); err != nil {
+		return
+	}
+
+	var header [4]byte
+
+	if _, err = io.ReadFull(log, header[:]); err != nil {
+		return
+	}
+
+	length := binary.BigEndian.Uint32(header[:])
+	encoded := make([]byte, length)
+
+	if _, err = io.ReadFull(log, encoded); err != nil {
+		return
+	}
+
+	err = gob.NewDecoder(bytes.NewReader(encoded)).Decode(&record)
+
+	return
+}
+
+// matchingOffsets returns, oldest first, the log offsets of every record
+// within (after, before), both bounds exclusive and a zero bound
+// ignored, that contains every token in words. An empty words list
+// matches every record in range.
+func matchingOffsets(tx *bolt.Tx, after time.Time, before time.Time, words []string) ([][]byte, error) {
+	timestamps := tx.Bucket(timeBucket)
+	c := timestamps.Cursor()
+
+	var candidates [][]byte
+	var keys [][]byte
+
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		t := timeFromKey(k)
+
+		if !after.IsZero() && !t.After(after) {
+			continue
+		}
+
+		if !before.IsZero() && !t.Before(before) {
+			continue
+		}
+
+		candidates = append(candidates, v)
+		keys = append(keys, k)
+	}
+
+	if len(words) == 0 {
+		return candidates, nil
+	}
+
+	matched := make([][]byte, 0, len(candidates))
+	wb := tx.Bucket(wordBucket)
+
+	for i, k := range keys {
+		allFound := true
+
+		for _, word := range words {
+			key := append([]byte(word), 0)
+			key = append(key, k...)
+
+			if wb.Get(key) == nil {
+				allFound = false
+				break
+			}
+		}
+
+		if allFound {
+			matched = append(matched, candidates[i])
+		}
+	}
+
+	return matched, nil
+}
+
+// timeKey encodes t as the first 8 bytes (so timeBucket's cursor still
+// scans in timestamp order) followed by the record's log offset, which
+// makes the key unique even when two records share a timestamp; without
+// it one of two same-millisecond messages would silently overwrite the
+// other's index entry and drop out of query/search results.
+func timeKey(t time.Time, offset int64) []byte {
+	var k [16]byte
+	binary.BigEndian.PutUint64(k[0:8], uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(k[8:16], uint64(offset))
+	return k[:]
+}
+
+func timeFromKey(k []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(k[0:8])))
+}
+
+func tokenize(s string) []string {
+	fields := strings.Fields(strings.ToLower(s))
+	return fields
+}
@@ -0,0 +1,284 @@
+// INTERLOCK | https://github.com/inversepath/interlock
+// Copyright (c) 2015 Inverse Path S.r.l.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package messaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) (*FileHistoryStore, string) {
+	dir := t.TempDir()
+	return NewFileHistoryStore(filepath.Join(dir, "log"), filepath.Join(dir, "idx"), []byte("test-mac-key")), dir
+}
+
+func TestAppendAndVerifyHistory(t *testing.T) {
+	s, _ := newTestStore(t)
+
+	for i := 0; i < 3; i++ {
+		if err := s.AppendHistory("alice", ">", "text/plain", "hello", time.Now()); err != nil {
+			t.Fatalf("AppendHistory: %v", err)
+		}
+	}
+
+	ok, brokenAt, err := s.VerifyHistory("alice")
+
+	if err != nil {
+		t.Fatalf("VerifyHistory: %v", err)
+	}
+
+	if !ok || brokenAt != -1 {
+		t.Fatalf("expected intact chain, got ok=%v brokenAt=%d", ok, brokenAt)
+	}
+}
+
+func TestVerifyHistoryReportsBreakPoint(t *testing.T) {
+	s, dir := newTestStore(t)
+	logPath := filepath.Join(dir, "log", "alice.log")
+
+	if err := s.AppendHistory("alice", ">", "text/plain", "hello", time.Now()); err != nil {
+		t.Fatalf("AppendHistory: %v", err)
+	}
+
+	info, err := os.Stat(logPath)
+
+	if err != nil {
+		t.Fatalf("stat log: %v", err)
+	}
+
+	secondRecordStart := info.Size()
+
+	for i := 0; i < 2; i++ {
+		if err := s.AppendHistory("alice", ">", "text/plain", "hello", time.Now()); err != nil {
+			t.Fatalf("AppendHistory: %v", err)
+		}
+	}
+
+	log, err := os.OpenFile(logPath, os.O_WRONLY, 0600)
+
+	if err != nil {
+		t.Fatalf("open log: %v", err)
+	}
+
+	// Flip a byte a few bytes into the second record (past its 4-byte
+	// length header, inside its encoded body), leaving the first record
+	// (index 0) untouched.
+	if _, err := log.WriteAt([]byte{0xff}, secondRecordStart+8); err != nil {
+		t.Fatalf("corrupt log: %v", err)
+	}
+	log.Close()
+
+	ok, brokenAt, err := s.VerifyHistory("alice")
+
+	if err != nil {
+		t.Fatalf("VerifyHistory: %v", err)
+	}
+
+	if ok {
+		t.Fatalf("expected corruption to be detected")
+	}
+
+	if brokenAt != 1 {
+		t.Fatalf("expected break at record 1, got %d", brokenAt)
+	}
+}
+
+// TestReconcileReplaysLogAheadOfIndex simulates a crash between
+// AppendHistory's log fsync and its matching index commit by writing a
+// record straight to the log file, bypassing the index entirely. A fresh
+// store opened against that log (standing in for the process restarting
+// after the crash) must recover the record via reconcile rather than
+// treating the empty index as an empty history.
+func TestReconcileReplaysLogAheadOfIndex(t *testing.T) {
+	s, dir := newTestStore(t)
+
+	record := HistoryRecord{Timestamp: time.Now(), Direction: ">", Mime: "text/plain", Body: "first"}
+
+	var buf bytes.Buffer
+
+	if err := gob.NewEncoder(&buf).Encode(record); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	encoded := buf.Bytes()
+	mac := s.mac(s.macKey, encoded)
+
+	logDir := filepath.Join(dir, "log")
+
+	if err := os.MkdirAll(logDir, 0700); err != nil {
+		t.Fatalf("mkdir log dir: %v", err)
+	}
+
+	log, err := os.OpenFile(filepath.Join(logDir, "alice.log"), os.O_WRONLY|os.O_CREATE, 0600)
+
+	if err != nil {
+		t.Fatalf("open log: %v", err)
+	}
+
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(encoded)))
+
+	if _, err := log.Write(header[:]); err != nil {
+		t.Fatalf("write header: %v", err)
+	}
+	if _, err := log.Write(encoded); err != nil {
+		t.Fatalf("write body: %v", err)
+	}
+	if _, err := log.Write(mac); err != nil {
+		t.Fatalf("write mac: %v", err)
+	}
+	log.Close()
+
+	records, err := s.QueryHistory("alice", time.Time{}, time.Time{}, 0, "")
+
+	if err != nil {
+		t.Fatalf("QueryHistory: %v", err)
+	}
+
+	if len(records) != 1 || records[0].Body != "first" {
+		t.Fatalf("expected reconcile to recover the record written straight to the log, got %+v", records)
+	}
+}
+
+// TestReconcileRefusesToAdvancePastBrokenChain simulates a log record
+// whose stored MAC does not match the chain (as opposed to a legitimate
+// dangling partial write): it is fully present on disk, past the index's
+// last reconciled offset, but corrupt. reconcile must refuse to treat it
+// as the new end of history instead of silently committing an offset
+// that would let the next append overwrite it.
+func TestReconcileRefusesToAdvancePastBrokenChain(t *testing.T) {
+	s, dir := newTestStore(t)
+	logPath := filepath.Join(dir, "log", "alice.log")
+
+	if err := s.AppendHistory("alice", ">", "text/plain", "first", time.Now()); err != nil {
+		t.Fatalf("AppendHistory: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	record := HistoryRecord{Timestamp: time.Now(), Direction: ">", Mime: "text/plain", Body: "second"}
+
+	var buf bytes.Buffer
+
+	if err := gob.NewEncoder(&buf).Encode(record); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	encoded := buf.Bytes()
+	badMAC := bytes.Repeat([]byte{0x00}, 32)
+
+	log, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0600)
+
+	if err != nil {
+		t.Fatalf("open log: %v", err)
+	}
+
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(encoded)))
+
+	if _, err := log.Write(header[:]); err != nil {
+		t.Fatalf("write header: %v", err)
+	}
+	if _, err := log.Write(encoded); err != nil {
+		t.Fatalf("write body: %v", err)
+	}
+	if _, err := log.Write(badMAC); err != nil {
+		t.Fatalf("write mac: %v", err)
+	}
+	log.Close()
+
+	beforeSize, err := os.Stat(logPath)
+
+	if err != nil {
+		t.Fatalf("stat log: %v", err)
+	}
+
+	s2 := NewFileHistoryStore(filepath.Join(dir, "log"), filepath.Join(dir, "idx"), []byte("test-mac-key"))
+
+	if err := s2.AppendHistory("alice", ">", "text/plain", "third", time.Now()); err == nil {
+		t.Fatalf("expected AppendHistory to refuse to advance over a broken chain, it succeeded")
+	}
+
+	// The log must survive untouched: a silent reconcile-and-overwrite
+	// would have truncated history starting at the broken record.
+	after, err := os.Stat(logPath)
+
+	if err != nil {
+		t.Fatalf("stat log: %v", err)
+	}
+
+	if after.Size() != beforeSize.Size() {
+		t.Fatalf("expected log to be untouched (size %d), got size %d", beforeSize.Size(), after.Size())
+	}
+}
+
+func TestTimeKeyCollision(t *testing.T) {
+	s, _ := newTestStore(t)
+
+	same := time.Unix(1700000000, 0)
+
+	if err := s.AppendHistory("alice", ">", "text/plain", "one", same); err != nil {
+		t.Fatalf("AppendHistory: %v", err)
+	}
+	if err := s.AppendHistory("alice", ">", "text/plain", "two", same); err != nil {
+		t.Fatalf("AppendHistory: %v", err)
+	}
+
+	records, err := s.QueryHistory("alice", time.Time{}, time.Time{}, 0, "")
+
+	if err != nil {
+		t.Fatalf("QueryHistory: %v", err)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("expected both same-timestamp records to be indexed, got %d", len(records))
+	}
+}
+
+func TestQueryHistorySearch(t *testing.T) {
+	s, _ := newTestStore(t)
+
+	now := time.Now()
+
+	if err := s.AppendHistory("alice", ">", "text/plain", "let's grab coffee tomorrow", now); err != nil {
+		t.Fatalf("AppendHistory: %v", err)
+	}
+	if err := s.AppendHistory("alice", ">", "text/plain", "see you at the meeting", now.Add(time.Second)); err != nil {
+		t.Fatalf("AppendHistory: %v", err)
+	}
+
+	records, err := s.QueryHistory("alice", time.Time{}, time.Time{}, 0, "coffee")
+
+	if err != nil {
+		t.Fatalf("QueryHistory: %v", err)
+	}
+
+	if len(records) != 1 || records[0].Body != "let's grab coffee tomorrow" {
+		t.Fatalf("expected search to match only the coffee message, got %+v", records)
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	got := tokenize("Hello   World\tfoo")
+	want := []string{"hello", "world", "foo"}
+
+	if len(got) != len(want) {
+		t.Fatalf("tokenize(%q) = %v, want %v", "Hello   World\tfoo", got, want)
+	}
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("tokenize(%q)[%d] = %q, want %q", "Hello   World\tfoo", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// INTERLOCK | https://github.com/inversepath/interlock
+// Copyright (c) 2015 Inverse Path S.r.l.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package messaging generalizes INTERLOCK secure messaging transports
+// (TextSecure/Signal, XMPP/OMEMO, Matrix/Olm, ...) behind a single Backend
+// interface, so that the HTTP routing, contact handling and history
+// plumbing do not need to be duplicated for every protocol.
+package messaging
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// BaseDir is the root directory under which backend-specific session
+// state and conversation history is stored. Each messaging cipher's
+// Activate sets it, before registering its backend, to the same
+// directory under the encrypted volume (mirroring the cipher's
+// storagePath() convention).
+var BaseDir string
+
+// HistoryPath joins BaseDir, a backend name and a contact identifier into
+// a per-contact history file path. Backend implementations that store
+// history as flat files can use this instead of duplicating the layout.
+func HistoryPath(backend string, contact string) string {
+	return filepath.Join(BaseDir, backend, "history", contact+".history")
+}
+
+// Message represents an inbound message delivered by a Backend to a
+// Receive handler.
+type Message struct {
+	Source      string
+	Body        string
+	Attachments []io.Reader
+}
+
+// Backend is implemented by every pluggable secure-messaging transport.
+type Backend interface {
+	// Send delivers a text message to a contact.
+	Send(contact string, msg string) error
+	// SendAttachment delivers a text message with a binary attachment.
+	SendAttachment(contact string, msg string, attachment io.Reader) error
+	// Receive blocks invoking handler for every inbound message until the
+	// backend is torn down or a transport error occurs.
+	Receive(handler func(Message)) error
+	// RegisterContact ensures local state (history file, attachment
+	// directory, session keys, ...) exists for a contact.
+	RegisterContact(contact string) error
+	// HistoryPath returns the path to the contact's conversation history.
+	HistoryPath(contact string) (string, error)
+}
+
+var backends = map[string]Backend{}
+
+// Register makes a Backend available under name to /api/messaging/<name>/...
+// requests. It is typically called from a cipher's init() or Activate().
+func Register(name string, b Backend) {
+	backends[name] = b
+}
+
+// Get looks up a previously Register-ed backend by name.
+func Get(name string) (Backend, error) {
+	b, ok := backends[name]
+
+	if !ok {
+		return nil, fmt.Errorf("unknown messaging backend: %s", name)
+	}
+
+	return b, nil
+}
+
+// Names returns the identifiers of all registered backends.
+func Names() []string {
+	names := make([]string, 0, len(backends))
+
+	for name := range backends {
+		names = append(names, name)
+	}
+
+	return names
+}
@@ -0,0 +1,125 @@
+// INTERLOCK | https://github.com/inversepath/interlock
+// Copyright (c) 2015 Inverse Path S.r.l.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build xmpp_omemo
+
+package messaging
+
+import (
+	"errors"
+	"io"
+
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/jid"
+)
+
+// omemoBackend implements Backend over XMPP, where a contact identifier
+// is a JID. It keeps a per-device session map but performs no OMEMO
+// encryption and no PEP bundle publishing or fetching: sends fail,
+// Receive returns io.EOF at once, and RegisterContact only checks the
+// JID (see encryptAndSend, nextMessage and fetchDeviceBundle).
+type omemoBackend struct {
+	session *xmpp.Session
+	self    jid.JID
+	devices map[string]*omemoDeviceSession
+}
+
+type omemoDeviceSession struct {
+	deviceID uint32
+	ratchet  []byte // serialized Double Ratchet session state
+}
+
+// NewOMEMOBackend registers an XMPP/OMEMO backend, using an already
+// authenticated XMPP session, under the name "xmpp".
+func NewOMEMOBackend(self jid.JID, session *xmpp.Session) {
+	Register("xmpp", &omemoBackend{
+		session: session,
+		self:    self,
+		devices: make(map[string]*omemoDeviceSession),
+	})
+}
+
+func (o *omemoBackend) Send(contact string, msg string) error {
+	to, err := jid.Parse(contact)
+
+	if err != nil {
+		return err
+	}
+
+	return o.encryptAndSend(to, []byte(msg))
+}
+
+func (o *omemoBackend) SendAttachment(contact string, msg string, attachment io.Reader) error {
+	to, err := jid.Parse(contact)
+
+	if err != nil {
+		return err
+	}
+
+	data, err := io.ReadAll(attachment)
+
+	if err != nil {
+		return err
+	}
+
+	if err := o.encryptAndSend(to, data); err != nil {
+		return err
+	}
+
+	return o.encryptAndSend(to, []byte(msg))
+}
+
+func (o *omemoBackend) Receive(handler func(Message)) error {
+	for {
+		from, plaintext, err := o.nextMessage()
+
+		if err != nil {
+			return err
+		}
+
+		handler(Message{Source: from.String(), Body: string(plaintext)})
+	}
+}
+
+func (o *omemoBackend) RegisterContact(contact string) error {
+	to, err := jid.Parse(contact)
+
+	if err != nil {
+		return err
+	}
+
+	return o.fetchDeviceBundle(to)
+}
+
+func (o *omemoBackend) HistoryPath(contact string) (string, error) {
+	to, err := jid.Parse(contact)
+
+	if err != nil {
+		return "", err
+	}
+
+	return HistoryPath("xmpp", to.String()), nil
+}
+
+// encryptAndSend always returns an error and sends nothing: there is no
+// OMEMO encryption here, and plaintext is never sent in its place, so
+// the caller sees a failed send rather than a false "OK".
+func (o *omemoBackend) encryptAndSend(to jid.JID, plaintext []byte) error {
+	return errors.New("OMEMO encryption is not implemented, refusing to send")
+}
+
+// fetchDeviceBundle returns nil without doing anything: it does not
+// fetch to's device list or PreKey bundles, nor establish sessions.
+func (o *omemoBackend) fetchDeviceBundle(to jid.JID) error {
+	return nil
+}
+
+// nextMessage returns io.EOF at once; it does not read stanzas from the
+// XMPP session or decrypt anything.
+func (o *omemoBackend) nextMessage() (jid.JID, []byte, error) {
+	var empty jid.JID
+	return empty, nil, io.EOF
+}
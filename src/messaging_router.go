@@ -0,0 +1,245 @@
+// INTERLOCK | https://github.com/inversepath/interlock
+// Copyright (c) 2015 Inverse Path S.r.l.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build textsecure
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inversepath/interlock/src/messaging"
+)
+
+// handleMessagingRequest serves the protocol-agnostic
+// /api/messaging/<backend>/send|history|contacts routes, dispatching to
+// whichever messaging.Backend registered under <backend>.
+func handleMessagingRequest(w http.ResponseWriter, r *http.Request) (res jsonObject) {
+	uri := strings.TrimPrefix(r.RequestURI, "/api/messaging/")
+	parts := strings.SplitN(uri, "/", 2)
+
+	if len(parts) != 2 {
+		return notFound(w)
+	}
+
+	backend, err := messaging.Get(parts[0])
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	switch parts[1] {
+	case "send":
+		res = messagingSend(backend, w, r)
+	case "history":
+		res = messagingHistory(backend, w, r)
+	case "history/verify":
+		res = messagingVerifyHistory(backend, w, r)
+	case "contacts":
+		res = messagingContacts(backend, w, r)
+	default:
+		res = notFound(w)
+	}
+
+	return
+}
+
+func messagingSend(backend messaging.Backend, w http.ResponseWriter, r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"contact:s", "msg:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	contact := req["contact"].(string)
+	msg := req["msg"].(string)
+
+	if a, ok := req["attachment"]; ok {
+		attachmentPath, err := absolutePath(a.(string))
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		attachment, err := os.Open(attachmentPath)
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+		defer attachment.Close()
+
+		err = backend.SendAttachment(contact, msg, attachment)
+	} else {
+		err = backend.Send(contact, msg)
+	}
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+
+	return
+}
+
+// messagingHistory serves /api/messaging/<backend>/history. Backends
+// implementing messaging.HistoryStore get pagination, full-text search
+// and tamper evidence; others fall back to their flat HistoryPath() file.
+func messagingHistory(backend messaging.Backend, w http.ResponseWriter, r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"contact:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	contact := req["contact"].(string)
+
+	store, ok := backend.(messaging.HistoryStore)
+
+	if !ok {
+		historyPath, err := backend.HistoryPath(contact)
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		history, err := ioutil.ReadFile(historyPath)
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		return jsonObject{
+			"status":   "OK",
+			"response": string(history),
+		}
+	}
+
+	var before, after time.Time
+	var limit int
+	var q string
+
+	if v, ok := req["before"]; ok {
+		if before, err = time.Parse(time.RFC3339, v.(string)); err != nil {
+			return errorResponse(err, "")
+		}
+	}
+
+	if v, ok := req["after"]; ok {
+		if after, err = time.Parse(time.RFC3339, v.(string)); err != nil {
+			return errorResponse(err, "")
+		}
+	}
+
+	if v, ok := req["limit"]; ok {
+		if limit, err = strconv.Atoi(v.(string)); err != nil {
+			return errorResponse(err, "")
+		}
+	}
+
+	if v, ok := req["q"]; ok {
+		q = v.(string)
+	}
+
+	records, err := store.QueryHistory(contact, before, after, limit, q)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": records,
+	}
+
+	return
+}
+
+// messagingVerifyHistory serves /api/messaging/<backend>/history/verify
+// for backends implementing messaging.HistoryStore.
+func messagingVerifyHistory(backend messaging.Backend, w http.ResponseWriter, r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"contact:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	store, ok := backend.(messaging.HistoryStore)
+
+	if !ok {
+		return errorResponse(errors.New("backend does not support history verification"), "")
+	}
+
+	okChain, brokenAt, err := store.VerifyHistory(req["contact"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	res = jsonObject{
+		"status": "OK",
+		"response": jsonObject{
+			"ok":       okChain,
+			"brokenAt": brokenAt,
+		},
+	}
+
+	return
+}
+
+func messagingContacts(backend messaging.Backend, w http.ResponseWriter, r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"contact:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = backend.RegisterContact(req["contact"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+
+	return
+}
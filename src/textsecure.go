@@ -9,7 +9,9 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"errors"
 	"flag"
 	"fmt"
@@ -22,28 +24,184 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/inversepath/interlock/src/messaging"
 	"github.com/janimo/textsecure"
+	textsecurev3 "github.com/signal-golang/textsecure"
 )
 
 const contactExt = "textsecure"
-const timeFormat = "Jan 02 15:04"
-const historySize = 10 * 1024
 
 var numberPattern = regexp.MustCompile("^(?:\\+|00)[0-9]+$")
+var groupPattern = regexp.MustCompile("^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$")
 var register = false
+var protocol = "v2"
+
+func init() {
+	// v2 stays the default until the v3 transport's sealed-sender and
+	// safety-number support actually lands upstream (see signalTransportV3).
+	flag.StringVar(&protocol, "textsecure-protocol", "v2", "TextSecure protocol version (v2 or v3)")
+}
+
+// signalTransport abstracts the Signal messaging backend so that the
+// textSecure cipher is not pinned to a single protocol implementation.
+type signalTransport interface {
+	// Send delivers a text message to a contact or group.
+	Send(to string, msg string) error
+	// SendAttachment delivers a text message with a binary attachment.
+	SendAttachment(to string, msg string, attachment io.Reader) error
+	// Register performs client setup against the backend (device
+	// registration, key generation, storage).
+	Register(client *textsecure.Client) error
+	// Listen blocks processing incoming messages until the backend is
+	// torn down or a transport error occurs.
+	Listen() error
+	// Identity returns the safety number (identity fingerprint) used to
+	// verify a contact out-of-band. Neither transport implements this yet
+	// (see signalTransportV2/V3 below), so it is not wired to an HTTP
+	// route; it is kept on the interface for the transport that does.
+	Identity(contact string) (string, error)
+	// Stop interrupts a blocked Listen call, if the backend supports it,
+	// so that listenerSupervisor.Stop() can unwind promptly on logout.
+	Stop() error
+}
+
+// signalTransportV2 wraps the legacy janimo/textsecure Protocol V2
+// implementation that this cipher has used historically.
+type signalTransportV2 struct{}
+
+func (s *signalTransportV2) Send(to string, msg string) error {
+	if groupPattern.MatchString(to) {
+		return errors.New("group messaging is not yet implemented for TextSecure Protocol V2")
+	}
+
+	return textsecure.SendMessage(to, msg)
+}
+
+func (s *signalTransportV2) SendAttachment(to string, msg string, attachment io.Reader) error {
+	if groupPattern.MatchString(to) {
+		return errors.New("group messaging is not yet implemented for TextSecure Protocol V2")
+	}
+
+	return textsecure.SendAttachment(to, msg, attachment)
+}
+
+func (s *signalTransportV2) Register(client *textsecure.Client) error {
+	return textsecure.Setup(client)
+}
+
+func (s *signalTransportV2) Listen() error {
+	return textsecure.ListenForMessages()
+}
+
+func (s *signalTransportV2) Identity(contact string) (string, error) {
+	return "", errors.New("safety number verification is not supported on TextSecure Protocol V2")
+}
+
+func (s *signalTransportV2) Stop() error {
+	// janimo/textsecure.ListenForMessages offers no way to interrupt a
+	// blocked call (https://github.com/janimo/textsecure/issues/16); the
+	// supervisor's retry loop still stops scheduling further attempts.
+	return errors.New("TextSecure Protocol V2 transport cannot be stopped")
+}
+
+// signalTransportV3 wraps github.com/signal-golang/textsecure, a community
+// fork that keeps janimo/textsecure alive. Its exported surface mirrors the
+// original almost field-for-field (Client{GetConfig, GetVerificationCode,
+// GetStoragePassword, MessageHandler, RegistrationDone}, SendMessage,
+// SendAttachment, ListenForMessages, Setup) but Config and Message are its
+// own types, not janimo's, so every value crossing the boundary needs
+// converting rather than reusing the v2 client as-is.
+//
+// The fork does not yet expose sealed-sender delivery, group messaging or
+// a safety-number API on its public surface, so Send/SendAttachment fall
+// back to regular (unsealed) 1:1 delivery and refuse group-UUID contacts
+// outright rather than silently misrouting them to the 1:1 path, and
+// Identity/Stop behave the same as on V2, until that support lands
+// upstream; protocol therefore still defaults to v2.
+type signalTransportV3 struct{}
+
+func (s *signalTransportV3) Send(to string, msg string) error {
+	if groupPattern.MatchString(to) {
+		return errors.New("group messaging is not yet implemented for TextSecure Protocol V3")
+	}
+
+	return textsecurev3.SendMessage(to, msg)
+}
+
+func (s *signalTransportV3) SendAttachment(to string, msg string, attachment io.Reader) error {
+	if groupPattern.MatchString(to) {
+		return errors.New("group messaging is not yet implemented for TextSecure Protocol V3")
+	}
+
+	return textsecurev3.SendAttachment(to, msg, attachment)
+}
+
+func (s *signalTransportV3) Register(client *textsecure.Client) error {
+	return textsecurev3.Setup(&textsecurev3.Client{
+		GetConfig: func() (*textsecurev3.Config, error) {
+			cfg, err := client.GetConfig()
+
+			if err != nil {
+				return nil, err
+			}
+
+			return &textsecurev3.Config{
+				Tel:              cfg.Tel,
+				VerificationType: cfg.VerificationType,
+				StorageDir:       cfg.StorageDir,
+				LogLevel:         cfg.LogLevel,
+			}, nil
+		},
+		GetVerificationCode: client.GetVerificationCode,
+		GetStoragePassword:  client.GetStoragePassword,
+		MessageHandler: func(msg *textsecurev3.Message) {
+			handleIncomingMessage(msg.Source(), msg.Message(), msg.Timestamp(), msg.Attachments())
+		},
+		RegistrationDone: client.RegistrationDone,
+	})
+}
+
+func (s *signalTransportV3) Listen() error {
+	return textsecurev3.ListenForMessages()
+}
+
+func (s *signalTransportV3) Identity(contact string) (string, error) {
+	return "", errors.New("safety number verification is not yet exposed by the signal-golang/textsecure fork")
+}
+
+func (s *signalTransportV3) Stop() error {
+	return errors.New("TextSecure Protocol V3 transport cannot be stopped")
+}
+
+func newSignalTransport(version string) (signalTransport, error) {
+	switch version {
+	case "v2":
+		return &signalTransportV2{}, nil
+	case "v3":
+		return &signalTransportV3{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported TextSecure protocol version: %s", version)
+	}
+}
 
 type textSecure struct {
-	info   cipherInfo
-	client *textsecure.Client
-	number string
+	info       cipherInfo
+	client     *textsecure.Client
+	transport  signalTransport
+	supervisor *listenerSupervisor
+	number     string
 
 	cipherInterface
 }
 
 type contactInfo struct {
-	Name          string
+	Name string
+	// Number holds either an E.164 contact number or, for group
+	// conversations, the group UUID assigned by the transport.
 	Number        string
 	HistoryPath   string
 	AttachmentDir string
@@ -54,10 +212,140 @@ func init() {
 	conf.SetAvailableCipher(new(textSecure).Init())
 }
 
+// signalBackend adapts textSecure to the generalized messaging.Backend
+// interface, so that the Signal transport can be reached both through the
+// legacy /api/textsecure/... routes and the protocol-agnostic
+// /api/messaging/textsecure/... ones.
+type signalBackend struct {
+	ts *textSecure
+}
+
+func (b *signalBackend) Send(contact string, msg string) error {
+	return b.ts.transport.Send(contact, msg)
+}
+
+func (b *signalBackend) SendAttachment(contact string, msg string, attachment io.Reader) error {
+	return b.ts.transport.SendAttachment(contact, msg, attachment)
+}
+
+// Receive registers handler for every inbound message and blocks until
+// the TextSecure listener is torn down. It deliberately does not call
+// transport.Listen() itself: that loop is already owned and retried by
+// t.supervisor (started in Activate), and a second concurrent Listen()
+// call against the same transport would race the first.
+func (b *signalBackend) Receive(handler func(messaging.Message)) error {
+	if b.ts.supervisor == nil {
+		return errors.New("TextSecure message listener is not running")
+	}
+
+	messageCallback = handler
+	defer func() { messageCallback = nil }()
+
+	<-b.ts.supervisor.ctx.Done()
+
+	return b.ts.supervisor.ctx.Err()
+}
+
+func (b *signalBackend) RegisterContact(contact string) error {
+	_, err := getContact(contact)
+	return err
+}
+
+func (b *signalBackend) HistoryPath(contact string) (string, error) {
+	c, err := getContact(contact)
+
+	if err != nil {
+		return "", err
+	}
+
+	return c.HistoryPath, nil
+}
+
+// AppendHistory, QueryHistory and VerifyHistory implement
+// messaging.HistoryStore on top of the tamper-evident activeHistory
+// store, so that /api/messaging/textsecure/history gets the same
+// pagination, search and integrity guarantees as /api/textsecure/history.
+func (b *signalBackend) AppendHistory(contact string, direction string, mime string, body string, t time.Time) error {
+	return activeHistory.AppendHistory(contact, direction, mime, body, t)
+}
+
+func (b *signalBackend) QueryHistory(contact string, before time.Time, after time.Time, limit int, q string) ([]messaging.HistoryRecord, error) {
+	return activeHistory.QueryHistory(contact, before, after, limit, q)
+}
+
+func (b *signalBackend) VerifyHistory(contact string) (bool, int, error) {
+	return activeHistory.VerifyHistory(contact)
+}
+
+// messageCallback, when set by signalBackend.Receive, is additionally
+// invoked by messageHandler for every inbound message, letting generic
+// messaging consumers observe TextSecure traffic.
+var messageCallback func(messaging.Message)
+
+// activeHistory is the tamper-evident history store backing
+// updateHistory/downloadHistory/verifyHistory, set up once in Activate.
+var activeHistory *messaging.FileHistoryStore
+
+// activeSupervisor is the running listenerSupervisor, used by
+// messageHandler to track in-flight invocations for draining on Stop().
+var activeSupervisor *listenerSupervisor
+
+// historyMACKeyDir holds the history MAC key outside the LUKS volume it
+// authenticates. An attacker who can read the mounted volume (the only
+// attacker the chain is meant to catch) must not also be able to read the
+// key that validates it, so it cannot live next to historyLogPath/
+// historyIndexPath under conf.mountPoint.
+const historyMACKeyDir = "/etc/interlock/textsecure"
+
+func historyMACKeyPath() string {
+	return filepath.Join(historyMACKeyDir, ".history_mac_key")
+}
+
+// deriveHistoryMACKey returns the key chaining the history log's
+// per-record HMACs. Deriving it via HKDF from the LUKS master key was
+// considered and dropped: cryptsetup/LUKS has no API to hand a running
+// process a mounted volume's master key short of `--dump-master-key` to a
+// file, which is deliberately awkward (and itself a key-on-disk problem)
+// to script into a long-running daemon. Instead we generate our own
+// random 256-bit key the first time TextSecure is activated and persist
+// it under historyMACKeyDir, off the encrypted volume, so that tampering
+// with the mounted log/index cannot also forge the key that detects it.
+func deriveHistoryMACKey() (key []byte, err error) {
+	path := historyMACKeyPath()
+
+	if existing, readErr := ioutil.ReadFile(path); readErr == nil && len(existing) == sha256.Size {
+		return existing, nil
+	}
+
+	key = make([]byte, sha256.Size)
+
+	if _, err = io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	if err = ioutil.WriteFile(path, key, 0600); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func historyLogPath() string {
+	return filepath.Join(conf.mountPoint, "textsecure", "history")
+}
+
+func historyIndexPath() string {
+	return filepath.Join(conf.mountPoint, "textsecure", "index")
+}
+
 func (t *textSecure) Init() (c cipherInterface) {
 	t.info = cipherInfo{
 		Name:        "TextSecure",
-		Description: "TextSecure/Signal protocol V2",
+		Description: "TextSecure/Signal protocol V2/V3",
 		KeyFormat:   "binary",
 		Enc:         false,
 		Dec:         false,
@@ -144,7 +432,13 @@ func (t *textSecure) Activate(postAuth bool) (c cipherInterface, err error) {
 		RegistrationDone:    t.registrationDone,
 	}
 
-	err = textsecure.Setup(t.client)
+	t.transport, err = newSignalTransport(protocol)
+
+	if err != nil {
+		return
+	}
+
+	err = t.transport.Register(t.client)
 
 	if err != nil {
 		err = fmt.Errorf("failed to enable TextSecure cipher: %v", err)
@@ -162,31 +456,65 @@ func (t *textSecure) Activate(postAuth bool) (c cipherInterface, err error) {
 		os.Exit(0)
 	}
 
-	status.Log(syslog.LOG_NOTICE, "enabling TextSecure message listener for %s", t.number)
+	messaging.BaseDir = filepath.Join(conf.mountPoint, "messaging")
+	messaging.Register("textsecure", &signalBackend{ts: t})
 
-	go func() {
-		// FIXME: currently there is no way to stop this, which is an
-		// issue when we logout (https://github.com/janimo/textsecure/issues/16)
-		err = textsecure.ListenForMessages()
+	macKey, err := deriveHistoryMACKey()
 
-		if err != nil {
-			status.Log(syslog.LOG_ERR, "failed to enable TextSecure message listener: %v", err)
-		}
-	}()
+	if err != nil {
+		err = fmt.Errorf("failed to derive TextSecure history MAC key: %v", err)
+		return
+	}
+
+	activeHistory = messaging.NewFileHistoryStore(historyLogPath(), historyIndexPath(), macKey)
+
+	status.Log(syslog.LOG_NOTICE, "enabling TextSecure message listener for %s", t.number)
+
+	activeSupervisor = newListenerSupervisor(func(ctx context.Context) error {
+		return t.transport.Listen()
+	}, t.transport.Stop)
+	t.supervisor = activeSupervisor
+	t.supervisor.Start()
 
 	return t, err
 }
 
+// Deactivate stops the TextSecure message listener, draining any
+// in-flight messageHandler invocations first. cipherInterface has no
+// Deactivate method of its own, so nothing outside this file is able to
+// call this directly by name; the session logout / LUKS-close path
+// instead type-asserts every active cipher against the unexported
+// interface{ Deactivate() error } (the same optional-capability pattern
+// as http.Flusher) and invokes it when present, so the listener is torn
+// down before the volume backing it goes away.
+func (t *textSecure) Deactivate() error {
+	if t.supervisor != nil {
+		t.supervisor.Stop()
+	}
+
+	if activeHistory != nil {
+		return activeHistory.Close()
+	}
+
+	return nil
+}
+
 func (t *textSecure) GetInfo() cipherInfo {
 	return t.info
 }
 
 func (t *textSecure) HandleRequest(w http.ResponseWriter, r *http.Request) (res jsonObject) {
-	switch r.RequestURI {
-	case "/api/textsecure/send":
-		res = sendMessage(w, r)
-	case "/api/textsecure/history":
+	switch {
+	case r.RequestURI == "/api/textsecure/send":
+		res = t.sendMessage(w, r)
+	case r.RequestURI == "/api/textsecure/history":
 		res = downloadHistory(w, r)
+	case r.RequestURI == "/api/textsecure/history/verify":
+		res = verifyHistory(w, r)
+	case r.RequestURI == "/api/textsecure/contacts":
+		res = t.contacts(w, r)
+	case strings.HasPrefix(r.RequestURI, "/api/messaging/"):
+		res = handleMessagingRequest(w, r)
 	default:
 		res = notFound(w)
 	}
@@ -194,7 +522,7 @@ func (t *textSecure) HandleRequest(w http.ResponseWriter, r *http.Request) (res
 	return
 }
 
-func sendMessage(w http.ResponseWriter, r *http.Request) (res jsonObject) {
+func (t *textSecure) sendMessage(w http.ResponseWriter, r *http.Request) (res jsonObject) {
 	var attachmentPath string
 	var attachment *os.File
 
@@ -243,21 +571,21 @@ func sendMessage(w http.ResponseWriter, r *http.Request) (res jsonObject) {
 		}
 		defer attachment.Close()
 
-		err = textsecure.SendAttachment(contact.Number, msg, attachment)
+		err = t.transport.SendAttachment(contact.Number, msg, attachment)
 
 		if err != nil {
 			return errorResponse(err, "")
 		}
 
-		err = updateHistory(contact, "["+path.Base(attachmentPath)+"] "+msg, ">", time.Now())
+		err = updateHistory(contact, "["+path.Base(attachmentPath)+"] "+msg, ">", "application/octet-stream", time.Now())
 	} else {
-		err = textsecure.SendMessage(contact.Number, msg)
+		err = t.transport.Send(contact.Number, msg)
 
 		if err != nil {
 			return errorResponse(err, "")
 		}
 
-		err = updateHistory(contact, msg, ">", time.Now())
+		err = updateHistory(contact, msg, ">", "text/plain", time.Now())
 	}
 
 	if err != nil {
@@ -272,6 +600,11 @@ func sendMessage(w http.ResponseWriter, r *http.Request) (res jsonObject) {
 	return
 }
 
+// downloadHistory serves /api/textsecure/history, returning the
+// contact's conversation records newest first. Optional "before"/"after"
+// parameters (RFC 3339 timestamps) bound the time range, "limit" caps the
+// number of records returned, and "q" restricts results to records whose
+// body contains every whitespace-separated term in q.
 func downloadHistory(w http.ResponseWriter, r *http.Request) (res jsonObject) {
 	req, err := parseRequest(r)
 
@@ -291,52 +624,92 @@ func downloadHistory(w http.ResponseWriter, r *http.Request) (res jsonObject) {
 		return errorResponse(err, "")
 	}
 
-	_, err = parseContact(contactPath)
+	contact, err := parseContact(contactPath)
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
-	input, err := os.Open(contactPath)
+	var before, after time.Time
+	var limit int
+	var q string
+
+	if v, ok := req["before"]; ok {
+		if before, err = time.Parse(time.RFC3339, v.(string)); err != nil {
+			return errorResponse(err, "")
+		}
+	}
+
+	if v, ok := req["after"]; ok {
+		if after, err = time.Parse(time.RFC3339, v.(string)); err != nil {
+			return errorResponse(err, "")
+		}
+	}
+
+	if v, ok := req["limit"]; ok {
+		if limit, err = strconv.Atoi(v.(string)); err != nil {
+			return errorResponse(err, "")
+		}
+	}
+
+	if v, ok := req["q"]; ok {
+		q = v.(string)
+	}
+
+	records, err := activeHistory.QueryHistory(contact.Number, before, after, limit, q)
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
-	defer input.Close()
 
-	stat, err := input.Stat()
+	res = jsonObject{
+		"status":   "OK",
+		"response": records,
+	}
+
+	return
+}
+
+// verifyHistory serves /api/textsecure/history/verify, walking the
+// contact's MAC chain and reporting whether it is intact or, if not, at
+// which record the chain broke (indicating truncation or tampering).
+func verifyHistory(w http.ResponseWriter, r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
-	trimOffset := 0
+	err = validateRequest(req, []string{"contact:s"})
 
-	if stat.Size() > historySize {
-		_, err = input.Seek(stat.Size()-historySize, 0)
+	if err != nil {
+		return errorResponse(err, "")
+	}
 
-		if err != nil {
-			return errorResponse(err, "")
-		}
+	contactPath, err := absolutePath(req["contact"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
 	}
 
-	history, err := ioutil.ReadAll(input)
+	contact, err := parseContact(contactPath)
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
-	if stat.Size() > historySize {
-		trimOffset = bytes.IndexByte(history, 0xa) // \n
+	ok, brokenAt, err := activeHistory.VerifyHistory(contact.Number)
 
-		if trimOffset < 0 {
-			trimOffset = 0
-		}
+	if err != nil {
+		return errorResponse(err, "")
 	}
 
 	res = jsonObject{
-		"status":   "OK",
-		"response": string(history[trimOffset:]),
+		"status": "OK",
+		"response": jsonObject{
+			"ok":       ok,
+			"brokenAt": brokenAt,
+		},
 	}
 
 	return
@@ -360,32 +733,49 @@ func (t *textSecure) getConfig() (*textsecure.Config, error) {
 }
 
 func messageHandler(msg *textsecure.Message) {
-	status.Log(syslog.LOG_NOTICE, "received message from %s\n", msg.Source())
+	handleIncomingMessage(msg.Source(), msg.Message(), msg.Timestamp(), msg.Attachments())
+}
+
+// handleIncomingMessage processes one inbound message in a way that does
+// not depend on which transport delivered it, so that both the v2 and v3
+// signalTransport implementations (whose Message types are distinct, not
+// shared) can feed it through the same history/attachment/notification
+// plumbing.
+func handleIncomingMessage(source string, body string, timestamp time.Time, attachments []io.Reader) {
+	if activeSupervisor != nil {
+		defer activeSupervisor.Track()()
+	}
+
+	status.Log(syslog.LOG_NOTICE, "received message from %s\n", source)
 
 	go func() {
-		n := status.Notify(syslog.LOG_NOTICE, "received message from %s\n", msg.Source())
+		n := status.Notify(syslog.LOG_NOTICE, "received message from %s\n", source)
 		time.Sleep(30 * time.Second)
 		status.Remove(n)
 	}()
 
-	contact, err := getContact(msg.Source())
+	if messageCallback != nil {
+		messageCallback(messaging.Message{Source: source, Body: body})
+	}
+
+	contact, err := getContact(source)
 
 	if err != nil {
 		status.Error(err)
 		return
 	}
 
-	if msg.Message() != "" {
-		updateHistory(contact, msg.Message(), "<", msg.Timestamp())
+	if body != "" {
+		updateHistory(contact, body, "<", "text/plain", timestamp)
 	}
 
-	for _, a := range msg.Attachments() {
+	for _, a := range attachments {
 		name, err := saveAttachment(contact, a)
 
 		if err != nil {
 			status.Error(err)
 		} else {
-			updateHistory(contact, "["+name+"]", "<", msg.Timestamp())
+			updateHistory(contact, "["+name+"]", "<", "application/octet-stream", timestamp)
 		}
 	}
 }
@@ -415,7 +805,7 @@ func saveAttachment(contact contactInfo, attachment io.Reader) (name string, err
 }
 
 func parseContact(path string) (contact contactInfo, err error) {
-	contactPattern := regexp.MustCompile("^" + contactsPath() + "/(([^/]*) ((?:\\+|00)[0-9]+))\\." + contactExt + "$")
+	contactPattern := regexp.MustCompile("^" + contactsPath() + "/(([^/]*) ((?:\\+|00)[0-9]+|[0-9a-fA-F-]{36}))\\." + contactExt + "$")
 	r := contactPattern.FindStringSubmatch(path)
 
 	if len(r) == 0 {
@@ -441,7 +831,7 @@ func parseContact(path string) (contact contactInfo, err error) {
 }
 
 func getContact(number string) (contact contactInfo, err error) {
-	if !numberPattern.MatchString(number) {
+	if !numberPattern.MatchString(number) && !groupPattern.MatchString(number) {
 		err = fmt.Errorf("invalid contact number format: %s", number)
 		return
 	}
@@ -452,6 +842,17 @@ func getContact(number string) (contact contactInfo, err error) {
 		return
 	}
 
+	// structured contacts (imported via vCard/CardDAV) take precedence
+	// over the legacy "Name +number.textsecure" filename convention
+	if sc, ok := findStoredContactByNumber(number); ok {
+		return contactInfo{
+			Name:          sc.Name,
+			Number:        number,
+			HistoryPath:   filepath.Join(contactsPath(), sc.Name+" "+number+"."+contactExt),
+			AttachmentDir: filepath.Join(attachmentsPath(), sc.Name+" "+number),
+		}, nil
+	}
+
 	contacts, err := filepath.Glob(contactsPath() + "/" + "*" + number + "." + contactExt)
 
 	if err != nil {
@@ -472,18 +873,12 @@ func getContact(number string) (contact contactInfo, err error) {
 	return
 }
 
-func updateHistory(contact contactInfo, msg string, prefix string, t time.Time) (err error) {
-	output, err := os.OpenFile(contact.HistoryPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+func updateHistory(contact contactInfo, msg string, prefix string, mime string, t time.Time) (err error) {
+	err = activeHistory.AppendHistory(contact.Number, prefix, mime, msg, t)
 
 	if err != nil {
 		status.Error(err)
-		return
 	}
-	defer output.Close()
-
-	h := fmt.Sprintf("%s %s %s\n", t.Format(timeFormat), prefix, msg)
-
-	output.Write([]byte(h))
 
 	return
 }
@@ -0,0 +1,164 @@
+// INTERLOCK | https://github.com/inversepath/interlock
+// Copyright (c) 2015 Inverse Path S.r.l.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build xmpp_omemo,textsecure
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/inversepath/interlock/src/messaging"
+	"mellium.im/sasl"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/dial"
+	"mellium.im/xmpp/jid"
+)
+
+// xmppMessaging is the cipherInterface wrapper around messaging's
+// XMPP/OMEMO backend. It only participates in the generic
+// /api/messaging/xmpp/... routes (see messaging_router.go, hence the
+// textsecure build tag pairing above: that router is only compiled into
+// the textsecure-tagged build) and does not itself support key
+// generation, encryption or signing.
+type xmppMessaging struct {
+	info cipherInfo
+
+	cipherInterface
+}
+
+var xmppAddress string
+var xmppPassword string
+
+func init() {
+	flag.StringVar(&xmppAddress, "xmpp-jid", "", "XMPP JID for OMEMO messaging (user@domain)")
+	flag.StringVar(&xmppPassword, "xmpp-password", "", "XMPP account password for OMEMO messaging")
+	conf.SetAvailableCipher(new(xmppMessaging).Init())
+}
+
+func (x *xmppMessaging) Init() (c cipherInterface) {
+	x.info = cipherInfo{
+		Name:        "XMPP/OMEMO",
+		Description: "XMPP secure messaging via XEP-0384 OMEMO",
+		KeyFormat:   "binary",
+		Enc:         false,
+		Dec:         false,
+		Sig:         false,
+		OTP:         false,
+		Msg:         true,
+		Extension:   "xmpp",
+	}
+
+	return x
+}
+
+func (x *xmppMessaging) New() cipherInterface {
+	return new(xmppMessaging).Init()
+}
+
+// Activate dials and authenticates the configured XMPP account and
+// registers the resulting session as the "xmpp" messaging backend, so
+// that NewOMEMOBackend actually gets called and /api/messaging/xmpp/...
+// requests reach it instead of failing with "unknown messaging backend".
+// It is a no-op before the volume is unlocked, same as
+// textSecure.Activate.
+func (x *xmppMessaging) Activate(postAuth bool) (c cipherInterface, err error) {
+	if !postAuth {
+		return x, nil
+	}
+
+	if xmppAddress == "" {
+		err = errors.New("XMPP/OMEMO cipher enabled but -xmpp-jid was not set")
+		return x, err
+	}
+
+	self, err := jid.Parse(xmppAddress)
+
+	if err != nil {
+		return x, fmt.Errorf("invalid -xmpp-jid: %v", err)
+	}
+
+	conn, err := dial.TLS(context.Background(), "tcp", self)
+
+	if err != nil {
+		return x, fmt.Errorf("failed to dial XMPP server for %s: %v", self, err)
+	}
+
+	session, err := xmpp.NewSession(
+		context.Background(),
+		self.Domain(),
+		self,
+		conn,
+		0,
+		xmpp.NewNegotiator(xmpp.StreamConfig{
+			Features: []xmpp.StreamFeature{
+				xmpp.BindResource(),
+				xmpp.SASL("", xmppPassword, sasl.Plain),
+			},
+		}),
+	)
+
+	if err != nil {
+		return x, fmt.Errorf("failed to establish XMPP session for %s: %v", self, err)
+	}
+
+	messaging.BaseDir = filepath.Join(conf.mountPoint, "messaging")
+	messaging.NewOMEMOBackend(self, session)
+
+	return x, nil
+}
+
+func (x *xmppMessaging) GetInfo() cipherInfo {
+	return x.info
+}
+
+func (x *xmppMessaging) HandleRequest(w http.ResponseWriter, r *http.Request) (res jsonObject) {
+	switch {
+	case strings.HasPrefix(r.RequestURI, "/api/messaging/"):
+		res = handleMessagingRequest(w, r)
+	default:
+		res = notFound(w)
+	}
+
+	return
+}
+
+func (x *xmppMessaging) GenKey(i string, e string) (p string, s string, err error) {
+	err = errors.New("cipher does not support key generation")
+	return
+}
+
+func (x *xmppMessaging) GetKeyInfo(k key) (i string, err error) {
+	i = "XMPP/OMEMO session state"
+	return
+}
+
+func (x *xmppMessaging) SetPassword(password string) error {
+	return errors.New("cipher does not support passwords")
+}
+
+func (x *xmppMessaging) Encrypt(input *os.File, output *os.File, _ bool) error {
+	return errors.New("cipher does not support encryption")
+}
+
+func (x *xmppMessaging) Decrypt(input *os.File, output *os.File, verify bool) error {
+	return errors.New("cipher does not support decryption")
+}
+
+func (x *xmppMessaging) Sign(input *os.File, output *os.File) error {
+	return errors.New("cipher does not support signing")
+}
+
+func (x *xmppMessaging) Verify(input *os.File, signature *os.File) error {
+	return errors.New("cipher does not support signature verification")
+}